@@ -5,11 +5,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/go-acme/lego/v4/challenge"
 	"github.com/go-acme/lego/v4/challenge/dns01"
 	"github.com/go-acme/lego/v4/log"
 	"github.com/go-acme/lego/v4/platform/config/env"
 	"github.com/mitchellh/mapstructure"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -17,11 +19,25 @@ import (
 )
 
 const (
-	EnvApiKey          = "ACTIVE24_API_KEY"
-	EnvApiUrl          = "ACTIVE24_API_URL"
+	EnvApiKey             = "ACTIVE24_API_KEY"
+	EnvApiUrl             = "ACTIVE24_API_URL"
+	EnvTTL                = "ACTIVE24_TTL"
+	EnvPropagationTimeout = "ACTIVE24_PROPAGATION_TIMEOUT"
+	EnvPollingInterval    = "ACTIVE24_POLLING_INTERVAL"
+	EnvHTTPTimeout        = "ACTIVE24_HTTP_TIMEOUT"
+	EnvSequenceInterval   = "ACTIVE24_SEQUENCE_INTERVAL"
+
 	DefaultEndpointUrl = "https://api.active24.com/"
+	DefaultTTL         = 300
 )
 
+var _ challenge.ProviderTimeout = (*DNSProvider)(nil)
+
+// This mirrors the unexported `sequential` interface the ACME client
+// type-asserts against for challenge providers that must serialize their
+// Present/CleanUp calls, the same way the check above does for Timeout().
+var _ interface{ Sequential() time.Duration } = (*DNSProvider)(nil)
+
 type dnsRecordTXTCreate struct {
 	Name string `json:"name"` // Name of the record.
 	Text string `json:"text"`
@@ -40,35 +56,84 @@ type HTTPClient interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
+// Config is used to configure the creation of the DNSProvider.
 type Config struct {
-	apiKey   string
-	endpoint string
+	APIKey   string
+	Endpoint string
+
+	TTL                int
+	PropagationTimeout time.Duration
+	PollingInterval    time.Duration
+	SequenceInterval   time.Duration
+	HTTPClient         *http.Client
 }
 
+// NewDefaultConfig returns a default configuration for the DNSProvider.
+func NewDefaultConfig() *Config {
+	return &Config{
+		Endpoint:           env.GetOrDefaultString(EnvApiUrl, DefaultEndpointUrl),
+		TTL:                env.GetOrDefaultInt(EnvTTL, DefaultTTL),
+		PropagationTimeout: env.GetOrDefaultSecond(EnvPropagationTimeout, 120*time.Second),
+		PollingInterval:    env.GetOrDefaultSecond(EnvPollingInterval, 2*time.Second),
+		SequenceInterval:   env.GetOrDefaultSecond(EnvSequenceInterval, 2*time.Second),
+		HTTPClient: &http.Client{
+			Timeout: env.GetOrDefaultSecond(EnvHTTPTimeout, 3*time.Second),
+		},
+	}
+}
+
+// DNSProvider implements the challenge.Provider interface.
 type DNSProvider struct {
 	config *Config
-	c      HTTPClient
+	client HTTPClient
+
+	// findZone resolves the hosted zone for a FQDN. It defaults to
+	// findZoneDomain, which performs a real DNS lookup; tests stub it out to
+	// stay hermetic.
+	findZone func(fqdn string) (string, error)
 }
 
-func NewDNSProviderConfig() (*Config, error) {
+// NewDNSProvider returns a DNSProvider instance configured for Active24.
+// Credentials must be passed in the environment variable ACTIVE24_API_KEY.
+func NewDNSProvider() (*DNSProvider, error) {
 	values, err := env.Get(EnvApiKey)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("active24: %w", err)
 	}
-	return &Config{
-		apiKey:   values[EnvApiKey],
-		endpoint: env.GetOrDefaultString(EnvApiUrl, DefaultEndpointUrl),
-	}, nil
+
+	config := NewDefaultConfig()
+	config.APIKey = values[EnvApiKey]
+
+	return NewDNSProviderConfig(config)
 }
 
-func NewDNSProvider() (*DNSProvider, error) {
-	conf, err := NewDNSProviderConfig()
-	if err != nil {
-		return nil, err
+// NewDNSProviderConfig return a DNSProvider instance configured for Active24.
+func NewDNSProviderConfig(config *Config) (*DNSProvider, error) {
+	if config == nil {
+		return nil, errors.New("active24: the configuration of the DNS provider is nil")
 	}
-	return &DNSProvider{conf, &http.Client{
-		Timeout: 3 * time.Second,
-	}}, nil
+
+	if config.APIKey == "" {
+		return nil, errors.New("active24: missing credentials")
+	}
+
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: 3 * time.Second}
+	}
+
+	return &DNSProvider{config: config, client: config.HTTPClient, findZone: findZoneDomain}, nil
+}
+
+// Timeout returns the timeout and interval to use when checking for DNS propagation.
+func (d *DNSProvider) Timeout() (timeout, interval time.Duration) {
+	return d.config.PropagationTimeout, d.config.PollingInterval
+}
+
+// Sequential enforces a minimum interval between Present/CleanUp calls so that
+// multiple challenges for the same domain (e.g. an apex and its wildcard) don't
+// race each other writing to the same Active24 zone.
+func (d *DNSProvider) Sequential() time.Duration {
+	return d.config.SequenceInterval
 }
 
 func (d *DNSProvider) newTXTRecord(name, text, domain string, ttl int) (*http.Request, error) {
@@ -80,12 +145,12 @@ func (d *DNSProvider) newTXTRecord(name, text, domain string, ttl int) (*http.Re
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/dns/%s/txt/v1", d.config.endpoint, domain), bytes.NewBuffer(body))
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/dns/%s/txt/v1", d.config.Endpoint, domain), bytes.NewBuffer(body))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", d.config.apiKey))
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", d.config.APIKey))
 	log.Infof("[%s]: prepared TXT DNS record call: %s with payload: %s", "active24", req.URL, req.Body)
 	return req, nil
 }
@@ -102,17 +167,58 @@ func extractSecondLvlDomain(domain string) (string, error) {
 
 }
 
+// findZoneDomain determines the zone Active24 actually hosts the record in,
+// by walking up fqdn's label tree looking for the enclosing SOA via a real
+// DNS lookup. This handles multi-label public suffixes (co.uk, com.au, ...)
+// and delegated sub-zones that extractSecondLvlDomain's naive last-two-labels
+// split gets wrong.
+func findZoneDomain(fqdn string) (string, error) {
+	return resolveZoneDomain(dns01.FindZoneByFqdn, fqdn)
+}
+
+// resolveZoneDomain drives findZoneDomain's logic against an injected zone
+// finder, so tests can exercise it with synthetic data instead of live DNS.
+// Only a network failure to reach the recursive nameservers falls back to the
+// naive last-two-labels split; any other error (e.g. a malformed name) is
+// returned as-is so it isn't silently masked.
+func resolveZoneDomain(zoneFinder func(string) (string, error), fqdn string) (string, error) {
+	zone, err := zoneFinder(fqdn)
+	if err != nil {
+		var netErr net.Error
+		if !errors.As(err, &netErr) {
+			return "", fmt.Errorf("active24: could not find zone for %s: %w", fqdn, err)
+		}
+		log.Warnf("[%s] zone lookup for %s failed (%v), falling back to naive second-level domain split", "active24", fqdn, err)
+		return extractSecondLvlDomain(dns01.UnFqdn(fqdn))
+	}
+	return dns01.UnFqdn(zone), nil
+}
+
 func (d *DNSProvider) Present(domain, token, keyAuth string) error {
 	// TODO better error handling / reporting
 	// TODO better URL parsing (rather than raw strings)
 	fqdn, value := dns01.GetRecord(domain, keyAuth)
-	log.Infof("[%s] ")
-	sld, err := extractSecondLvlDomain(domain)
+	log.Infof("[%s] present record for %s", "active24", fqdn)
+	sld, err := d.findZone(fqdn)
+	if err != nil {
+		return err
+	}
+
+	unFqdn := dns01.UnFqdn(fqdn)
+	_, found, err := d.findTXTRecord(sld, unFqdn, value)
 	if err != nil {
 		return err
 	}
-	req, err := d.newTXTRecord(dns01.UnFqdn(fqdn), value, sld, 300)
-	resp, err := d.c.Do(req)
+	if found {
+		log.Infof("[%s] TXT record already present for %s, skipping creation", "active24", fqdn)
+		return nil
+	}
+
+	req, err := d.newTXTRecord(unFqdn, value, sld, d.config.TTL)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -135,7 +241,7 @@ func (d *DNSProvider) Present(domain, token, keyAuth string) error {
 }
 
 func (d *DNSProvider) deleteTXTRecord(domain, hashId string) error {
-	u, err := url.Parse(fmt.Sprintf("%s/dns/%s/%s/v1", d.config.endpoint, domain, hashId))
+	u, err := url.Parse(fmt.Sprintf("%s/dns/%s/%s/v1", d.config.Endpoint, domain, hashId))
 	if err != nil {
 		return err
 	}
@@ -144,9 +250,9 @@ func (d *DNSProvider) deleteTXTRecord(domain, hashId string) error {
 		return err
 	}
 	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", d.config.apiKey))
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", d.config.APIKey))
 
-	resp, err := d.c.Do(req)
+	resp, err := d.client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -168,24 +274,41 @@ func (d *DNSProvider) deleteTXTRecord(domain, hashId string) error {
 	}
 }
 
-func (d *DNSProvider) getDomainHashId(domain string, fqdn string) ([]string, error) {
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/dns/%s/records/v1", d.config.endpoint, domain), nil)
+// listTXTRecords returns the TXT records of domain whose name matches fqdn.
+func (d *DNSProvider) listTXTRecords(domain, fqdn string) ([]dnsRecordTXT, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/dns/%s/records/v1", d.config.Endpoint, domain), nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", d.config.apiKey))
-	resp, err := d.c.Do(req)
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", d.config.APIKey))
+	resp, err := d.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// fall through to decode the record list below.
+	case http.StatusUnauthorized:
+		return nil, errors.New("authentication was not successful")
+	case http.StatusForbidden:
+		return nil, fmt.Errorf("not authorized")
+	case http.StatusTooManyRequests:
+		return nil, errors.New("rate limited, try again later")
+	case http.StatusInternalServerError:
+		return nil, errors.New("internal server error, try again later")
+	default:
+		return nil, fmt.Errorf("unhandled http status response. Status code: %v\n Response: %v\n Request: %v\n", resp.StatusCode, resp, req)
+	}
+
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 	var records []map[string]interface{}
-	var hashIds []string
+	var txtRecords []dnsRecordTXT
 	err = json.Unmarshal(body, &records)
 	if err != nil {
 		return nil, err
@@ -205,14 +328,41 @@ func (d *DNSProvider) getDomainHashId(domain string, fqdn string) ([]string, err
 		if txtRec.Name != fqdn {
 			continue
 		}
-		hashIds = append(hashIds, txtRec.HashId)
+		txtRecords = append(txtRecords, txtRec)
+	}
+	return txtRecords, nil
+}
+
+func (d *DNSProvider) getDomainHashId(domain string, fqdn string) ([]string, error) {
+	records, err := d.listTXTRecords(domain, fqdn)
+	if err != nil {
+		return nil, err
+	}
+	var hashIds []string
+	for _, r := range records {
+		hashIds = append(hashIds, r.HashId)
 	}
 	return hashIds, nil
 }
 
+// findTXTRecord looks up the TXT record for fqdn whose value matches text.
+// It is used by Present to avoid creating a duplicate record on repeated runs.
+func (d *DNSProvider) findTXTRecord(domain, fqdn, text string) (hashId string, found bool, err error) {
+	records, err := d.listTXTRecords(domain, fqdn)
+	if err != nil {
+		return "", false, err
+	}
+	for _, r := range records {
+		if r.Text == text {
+			return r.HashId, true, nil
+		}
+	}
+	return "", false, nil
+}
+
 func (d *DNSProvider) CleanUp(domain, token, keyAuth string) error {
 	fqdn, _ := dns01.GetRecord(domain, keyAuth)
-	sld, err := extractSecondLvlDomain(domain)
+	sld, err := d.findZone(fqdn)
 	if err != nil {
 		return err
 	}
@@ -2,7 +2,10 @@ package active24
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/go-acme/lego/v4/challenge/dns01"
 	"github.com/go-acme/lego/v4/platform/tester"
 	"github.com/stretchr/testify/require"
 	"io/ioutil"
@@ -10,7 +13,7 @@ import (
 	"testing"
 )
 
-var envVals = tester.NewEnvTest(EnvApiKey, EnvApiUrl)
+var envVals = tester.NewEnvTest(EnvApiKey, EnvApiUrl, EnvTTL, EnvPropagationTimeout, EnvPollingInterval, EnvHTTPTimeout, EnvSequenceInterval)
 
 type MockHTTPClient struct {
 	DoFunc func(req *http.Request) (*http.Response, error)
@@ -36,16 +39,33 @@ func validateHeaders(req *http.Request) error {
 	}
 	return nil
 }
+// hermeticFindZone stubs out findZoneDomain's live DNS lookup with the naive
+// last-two-labels split, so tests driving Present/CleanUp never touch the
+// network.
+func hermeticFindZone(fqdn string) (string, error) {
+	return extractSecondLvlDomain(dns01.UnFqdn(fqdn))
+}
+
 func setupFakeDNSProvider(t *testing.T, statusCode int, body []byte) *DNSProvider {
 	t.Helper()
-	conf, err := NewDNSProviderConfig()
-	require.NoError(t, err)
+	config := NewDefaultConfig()
+	config.APIKey = "api-key"
 	return &DNSProvider{
-		config: conf,
-		c: &MockHTTPClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		config:   config,
+		findZone: hermeticFindZone,
+		client: &MockHTTPClient{DoFunc: func(req *http.Request) (*http.Response, error) {
 			if err := validateHeaders(req); err != nil {
 				return nil, err
 			}
+			// Present looks up existing records before creating a new one: answer that
+			// lookup with an empty list so callers that only care about the create/delete
+			// response don't also have to stub it.
+			if req.Method == http.MethodGet && body == nil {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       ioutil.NopCloser(bytes.NewBuffer([]byte("[]"))),
+				}, nil
+			}
 			if body != nil {
 				return &http.Response{
 					StatusCode: statusCode,
@@ -59,44 +79,110 @@ func setupFakeDNSProvider(t *testing.T, statusCode int, body []byte) *DNSProvide
 	}
 }
 
-func TestNewDNSProviderConfig(t *testing.T) {
+// setupFakeDNSProviderFailingLookup fails the GET lookup Present/CleanUp make
+// before creating/deleting a record, so tests can assert that a lookup-call
+// failure surfaces the same clean error strings as a create/delete failure,
+// instead of an opaque JSON decode error.
+func setupFakeDNSProviderFailingLookup(t *testing.T, statusCode int) *DNSProvider {
+	t.Helper()
+	config := NewDefaultConfig()
+	config.APIKey = "api-key"
+	return &DNSProvider{
+		config:   config,
+		findZone: hermeticFindZone,
+		client: &MockHTTPClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+			if err := validateHeaders(req); err != nil {
+				return nil, err
+			}
+			if req.Method == http.MethodGet {
+				return &http.Response{StatusCode: statusCode}, nil
+			}
+			return &http.Response{StatusCode: http.StatusNoContent}, nil
+		}},
+	}
+}
+
+func TestDNSProviderPresentLookupFailure(t *testing.T) {
 	tt := []struct {
-		desc    string
-		envVars map[string]string
-		want    *Config
+		desc         string
+		expected     string
+		expectedCode int
 	}{
 		{
-			desc: "default config",
-			envVars: map[string]string{
-				EnvApiKey: "qwerty123456-ok",
-			},
-			want: &Config{
-				apiKey:   "qwerty123456-ok",
-				endpoint: DefaultEndpointUrl,
-			},
+			desc:         "invalid API key",
+			expected:     "authentication was not successful",
+			expectedCode: http.StatusUnauthorized,
 		},
 		{
-			desc: "endpoint override",
-			envVars: map[string]string{
-				EnvApiKey: "api-key",
-				EnvApiUrl: "https://custom.api.com",
-			},
-			want: &Config{
-				apiKey:   "api-key",
-				endpoint: "https://custom.api.com",
-			},
+			desc:         "hitting rate limiting",
+			expected:     "rate limited, try again later",
+			expectedCode: http.StatusTooManyRequests,
+		},
+		{
+			desc:         "server-side error",
+			expected:     "internal server error, try again later",
+			expectedCode: http.StatusInternalServerError,
+		},
+		{
+			desc:         "authorization error",
+			expected:     "not authorized",
+			expectedCode: http.StatusForbidden,
 		},
 	}
+
 	for _, test := range tt {
 		t.Run(test.desc, func(t *testing.T) {
 			defer envVals.RestoreEnv()
 			envVals.ClearEnv()
-			envVals.Apply(test.envVars)
+			envVals.Apply(map[string]string{EnvApiKey: "api-key"})
 
-			c, err := NewDNSProviderConfig()
-			if test.want != nil {
-				require.Equal(t, c, test.want)
+			p := setupFakeDNSProviderFailingLookup(t, test.expectedCode)
+			err := p.Present("example.com", "", "foo")
+			require.EqualError(t, err, test.expected)
+		})
+	}
+}
+
+func TestNewDefaultConfig(t *testing.T) {
+	defer envVals.RestoreEnv()
+	envVals.ClearEnv()
+
+	config := NewDefaultConfig()
+
+	require.Equal(t, DefaultEndpointUrl, config.Endpoint)
+	require.Equal(t, DefaultTTL, config.TTL)
+}
+
+func TestNewDNSProviderConfig(t *testing.T) {
+	tt := []struct {
+		desc     string
+		config   *Config
+		expected string
+	}{
+		{
+			desc:     "nil config",
+			expected: "active24: the configuration of the DNS provider is nil",
+		},
+		{
+			desc:     "missing api key",
+			config:   &Config{},
+			expected: "active24: missing credentials",
+		},
+		{
+			desc: "success",
+			config: &Config{
+				APIKey: "api-key",
+			},
+		},
+	}
+	for _, test := range tt {
+		t.Run(test.desc, func(t *testing.T) {
+			p, err := NewDNSProviderConfig(test.config)
+			if len(test.expected) == 0 {
 				require.NoError(t, err)
+				require.NotNil(t, p)
+			} else {
+				require.EqualError(t, err, test.expected)
 			}
 		})
 	}
@@ -120,7 +206,7 @@ func TestNewDNSProvider(t *testing.T) {
 			envVars: map[string]string{
 				"ACTIVE24_API_KEY": "",
 			},
-			expected: "some credentials information are missing: ACTIVE24_API_KEY",
+			expected: "active24: some credentials information are missing: ACTIVE24_API_KEY",
 		},
 	}
 	for _, test := range tt {
@@ -310,6 +396,202 @@ func TestGetDomainHashIds(t *testing.T) {
 	}
 }
 
+// TestPresentSequentialSameFQDN simulates a wildcard + apex issuance, where two
+// Present calls target the same _acme-challenge FQDN with different keyAuth
+// values. Both TXT records must end up on the zone simultaneously, which is
+// what lets lego serialize them via Sequential() rather than racing the API.
+func TestPresentSequentialSameFQDN(t *testing.T) {
+	defer envVals.RestoreEnv()
+	envVals.ClearEnv()
+	envVals.Apply(map[string]string{EnvApiKey: "api-key"})
+
+	var records []dnsRecordTXT
+
+	client := &MockHTTPClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		if err := validateHeaders(req); err != nil {
+			return nil, err
+		}
+		switch req.Method {
+		case http.MethodGet:
+			body, err := json.Marshal(records)
+			if err != nil {
+				return nil, err
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewBuffer(body))}, nil
+		case http.MethodPost:
+			var created dnsRecordTXTCreate
+			reqBody, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			if err := json.Unmarshal(reqBody, &created); err != nil {
+				return nil, err
+			}
+			records = append(records, dnsRecordTXT{
+				Name:   created.Name,
+				TTL:    created.TTL,
+				Text:   created.Text,
+				HashId: fmt.Sprintf("hash-%d", len(records)),
+				Type:   "TXT",
+			})
+			return &http.Response{StatusCode: http.StatusNoContent}, nil
+		default:
+			return nil, fmt.Errorf("unexpected method %s", req.Method)
+		}
+	}}
+
+	config := NewDefaultConfig()
+	config.APIKey = "api-key"
+	p := &DNSProvider{config: config, client: client, findZone: hermeticFindZone}
+
+	require.NoError(t, p.Present("example.com", "", "keyAuth1"))
+	require.NoError(t, p.Present("example.com", "", "keyAuth2"))
+
+	fqdn, value1 := dns01.GetRecord("example.com", "keyAuth1")
+	_, value2 := dns01.GetRecord("example.com", "keyAuth2")
+
+	hashIds, err := p.getDomainHashId("example.com", dns01.UnFqdn(fqdn))
+	require.NoError(t, err)
+	require.Len(t, hashIds, 2)
+
+	var values []string
+	for _, r := range records {
+		values = append(values, r.Text)
+	}
+	require.ElementsMatch(t, []string{value1, value2}, values)
+}
+
+func TestFindTXTRecord(t *testing.T) {
+	body := `[
+	{
+	"name": "example.com",
+	"ttl": 0,
+	"ip": "1.2.3.4",
+	"hashId": "abcde",
+	"type": "A"
+	},
+	{
+	"name": "_acme-challenge.example.com",
+	"ttl": 0,
+	"text": "abcd",
+	"hashId": "qwerty",
+	"type": "TXT"
+	},
+	{
+	"name": "_acme-challenge.example.com",
+	"ttl": 0,
+	"text": "efgh",
+	"hashId": "123456",
+	"type": "TXT"
+	}
+	]
+	`
+
+	tests := []struct {
+		name      string
+		fqdn      string
+		text      string
+		wantHash  string
+		wantFound bool
+	}{
+		{
+			name:      "matching record found",
+			fqdn:      "_acme-challenge.example.com",
+			text:      "efgh",
+			wantHash:  "123456",
+			wantFound: true,
+		},
+		{
+			name:      "no record with that text",
+			fqdn:      "_acme-challenge.example.com",
+			text:      "unknown",
+			wantFound: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer envVals.RestoreEnv()
+			envVals.ClearEnv()
+			envVals.Apply(map[string]string{
+				EnvApiKey: "api-key",
+			})
+
+			p := setupFakeDNSProvider(t, http.StatusOK, []byte(body))
+			hashId, found, err := p.findTXTRecord("example.com", test.fqdn, test.text)
+			require.NoError(t, err)
+			require.Equal(t, test.wantFound, found)
+			require.Equal(t, test.wantHash, hashId)
+		})
+	}
+}
+
+// fakeNetError satisfies net.Error so resolveZoneDomain's fallback path can be
+// exercised without touching a real network.
+type fakeNetError struct{ msg string }
+
+func (e fakeNetError) Error() string   { return e.msg }
+func (e fakeNetError) Timeout() bool   { return true }
+func (e fakeNetError) Temporary() bool { return true }
+
+// TestResolveZoneDomain drives findZoneDomain's logic against an injected
+// zone finder, so it covers the cases extractSecondLvlDomain's naive
+// last-two-labels split gets wrong (a multi-label public suffix, a zone cut
+// at a subdomain) and the fallback rules, all with synthetic data instead of
+// asserting ground truth about real third-party domains.
+func TestResolveZoneDomain(t *testing.T) {
+	tests := []struct {
+		name       string
+		fqdn       string
+		zoneFinder func(string) (string, error)
+		want       string
+		wantErr    string
+	}{
+		{
+			name: "multi-label public suffix resolved by zone finder",
+			fqdn: "_acme-challenge.foo.example.co.uk.",
+			zoneFinder: func(string) (string, error) {
+				return "example.co.uk.", nil
+			},
+			want: "example.co.uk",
+		},
+		{
+			name: "zone cut at a delegated sub-zone resolved by zone finder",
+			fqdn: "_acme-challenge.sub.example.com.",
+			zoneFinder: func(string) (string, error) {
+				return "sub.example.com.", nil
+			},
+			want: "sub.example.com",
+		},
+		{
+			name: "network failure falls back to the naive split",
+			fqdn: "_acme-challenge.foo.example.co.uk.",
+			zoneFinder: func(string) (string, error) {
+				return "", fakeNetError{msg: "no route to nameserver"}
+			},
+			want: "example.co.uk",
+		},
+		{
+			name: "non-network error is returned as-is, not masked by the fallback",
+			fqdn: "_acme-challenge.example.com.",
+			zoneFinder: func(string) (string, error) {
+				return "", errors.New("NXDOMAIN")
+			},
+			wantErr: "active24: could not find zone for _acme-challenge.example.com.: NXDOMAIN",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := resolveZoneDomain(test.zoneFinder, test.fqdn)
+			if len(test.wantErr) != 0 {
+				require.EqualError(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
+
 func TestExtractSecondLvlDomain(t *testing.T) {
 	tests := []struct {
 		name   string